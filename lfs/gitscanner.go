@@ -1,7 +1,16 @@
 package lfs
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +20,10 @@ import (
 	"github.com/rubyist/tracerx"
 )
 
+// lfsConcurrentScansConfigKey is the git config key used to override the
+// default scan concurrency computed from runtime.GOMAXPROCS.
+const lfsConcurrentScansConfigKey = "lfs.concurrentscans"
+
 var missingCallbackErr = errors.New(tr.Tr.Get("no callback given"))
 
 // IsCallbackMissing returns a boolean indicating whether the error is reporting
@@ -25,25 +38,141 @@ type GitScanner struct {
 	FoundPointer       GitScannerFoundPointer
 	FoundLockable      GitScannerFoundLockable
 	PotentialLockables GitScannerSet
-	remote             string
-	skippedRefs        []string
+	// Progress, if set, receives periodic GitScannerProgressUpdate values
+	// while a scan is in flight, throttled to ProgressInterval.
+	// ScanPreviousVersions sends no updates, not even the closing one with
+	// Done set.
+	Progress GitScannerProgress
+	// ProgressInterval overrides the throttle between Progress updates.
+	// Zero means DefaultGitScannerProgressInterval.
+	ProgressInterval time.Duration
+	// Concurrency is the number of include refs that may be walked in
+	// parallel. Zero means fall back to the lfs.concurrentscans git config
+	// value, then runtime.GOMAXPROCS(0).
+	Concurrency int
+	remote      string
+	skippedRefs []string
 
 	closed  bool
 	started time.Time
 	cfg     *config.Configuration
+	ctx     context.Context
 }
 
 type GitScannerFoundPointer func(*WrappedPointer, error)
 type GitScannerFoundLockable func(filename string)
 
+// GitScannerProgress receives periodic snapshots of a scan's progress.
+type GitScannerProgress func(update GitScannerProgressUpdate)
+
+// GitScannerProgressUpdate is a snapshot of a scan's progress, cumulative
+// since the scan started. The update for which Done is true is the last one
+// sent for that scan, so consumers can render a closing summary without
+// tracking totals themselves across every GitScannerFoundPointer call.
+type GitScannerProgressUpdate struct {
+	CommitsWalked              uint64
+	TreesWalked                uint64
+	BlobsExamined              uint64
+	PointersFound              uint64
+	BytesConsideredFromCatFile uint64
+	Done                       bool
+}
+
+// DefaultGitScannerProgressInterval is the throttle interval used between
+// GitScannerProgress updates when GitScanner.ProgressInterval is unset.
+const DefaultGitScannerProgressInterval = 500 * time.Millisecond
+
+// scanProgressTracker accumulates GitScannerProgressUpdate counters for a
+// single scan and throttles delivery of them to at most once per interval.
+// It is safe for concurrent use so every shard of a concurrent scan can
+// report into it.
+type scanProgressTracker struct {
+	cb       GitScannerProgress
+	interval time.Duration
+
+	mu       sync.Mutex
+	last     time.Time
+	snapshot GitScannerProgressUpdate
+}
+
+func newScanProgressTracker(cb GitScannerProgress, interval time.Duration) *scanProgressTracker {
+	return &scanProgressTracker{cb: cb, interval: interval}
+}
+
+func (t *scanProgressTracker) addCommits(n uint64) {
+	t.add(func(u *GitScannerProgressUpdate) { u.CommitsWalked += n })
+}
+
+func (t *scanProgressTracker) addTrees(n uint64) {
+	t.add(func(u *GitScannerProgressUpdate) { u.TreesWalked += n })
+}
+
+func (t *scanProgressTracker) addBlobs(n uint64) {
+	t.add(func(u *GitScannerProgressUpdate) { u.BlobsExamined += n })
+}
+
+func (t *scanProgressTracker) addPointers(n uint64) {
+	t.add(func(u *GitScannerProgressUpdate) { u.PointersFound += n })
+}
+
+func (t *scanProgressTracker) addBytes(n uint64) {
+	t.add(func(u *GitScannerProgressUpdate) { u.BytesConsideredFromCatFile += n })
+}
+
+func (t *scanProgressTracker) add(mutate func(*GitScannerProgressUpdate)) {
+	if t == nil || t.cb == nil {
+		return
+	}
+
+	t.mu.Lock()
+	mutate(&t.snapshot)
+	due := time.Since(t.last) >= t.interval
+	var update GitScannerProgressUpdate
+	if due {
+		t.last = time.Now()
+		update = t.snapshot
+	}
+	t.mu.Unlock()
+
+	if due {
+		t.cb(update)
+	}
+}
+
+// done emits a final update with Done set, bypassing the throttle, so
+// callers always see a closing summary even for scans too short to have
+// crossed the interval.
+func (t *scanProgressTracker) done() {
+	if t == nil || t.cb == nil {
+		return
+	}
+
+	t.mu.Lock()
+	update := t.snapshot
+	t.mu.Unlock()
+
+	update.Done = true
+	t.cb(update)
+}
+
+// GitScannerSet is consulted from every shard of a concurrent scan, so
+// implementations of Contains must be safe to call from multiple goroutines
+// at once.
 type GitScannerSet interface {
 	Contains(string) bool
 }
 
 // NewGitScanner initializes a *GitScanner for a Git repository in the current
-// working directory.
-func NewGitScanner(cfg *config.Configuration, cb GitScannerFoundPointer) *GitScanner {
-	return &GitScanner{started: time.Now(), FoundPointer: cb, cfg: cfg}
+// working directory. ctx bounds the lifetime of every scan the returned
+// GitScanner performs: cancelling it, or letting a deadline on it elapse,
+// terminates the underlying git subprocesses and unblocks the goroutines
+// feeding FoundPointer instead of waiting for them to drain. A nil ctx is
+// treated as context.Background().
+func NewGitScanner(ctx context.Context, cfg *config.Configuration, cb GitScannerFoundPointer) *GitScanner {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &GitScanner{ctx: ctx, started: time.Now(), FoundPointer: cb, cfg: cfg}
 }
 
 // Close stops exits once all processing has stopped, and all resources are
@@ -72,6 +201,13 @@ func (s *GitScanner) RemoteForPush(r string) {
 // "include" ref but not reachable from any "exclude" refs and which the
 // given remote does not have. See RemoteForPush().
 func (s *GitScanner) ScanMultiRangeToRemote(include string, exclude []string, cb GitScannerFoundPointer) error {
+	return s.ScanMultiRangeToRemoteContext(s.ctx, include, exclude, cb)
+}
+
+// ScanMultiRangeToRemoteContext is like ScanMultiRangeToRemote, but scopes the
+// scan to ctx instead of the one passed to NewGitScanner, so a single call
+// can be cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanMultiRangeToRemoteContext(ctx context.Context, include string, exclude []string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
@@ -81,19 +217,28 @@ func (s *GitScanner) ScanMultiRangeToRemote(include string, exclude []string, cb
 		return errors.New(tr.Tr.Get("unable to scan starting at %q: no remote set", include))
 	}
 
-	return scanRefsToChanSingleIncludeMultiExclude(s, callback, include, exclude, s.cfg.GitEnv(), s.cfg.OSEnv(), s.opts(ScanRangeToRemoteMode))
+	opts := s.opts(ctx, ScanRangeToRemoteMode)
+	defer opts.tracker().done()
+	return scanRefsToChanSingleIncludeMultiExclude(s, callback, include, exclude, s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
 }
 
 // ScanRefs scans through all unique objects reachable from the "include" refs
 // but not reachable from any "exclude" refs, including objects that have
 // been modified or deleted.
 func (s *GitScanner) ScanRefs(include, exclude []string, cb GitScannerFoundPointer) error {
+	return s.ScanRefsContext(s.ctx, include, exclude, cb)
+}
+
+// ScanRefsContext is like ScanRefs, but scopes the scan to ctx instead of the
+// one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanRefsContext(ctx context.Context, include, exclude []string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanRefsMode)
+	opts := s.opts(ctx, ScanRefsMode)
 	opts.SkipDeletedBlobs = false
 	return scanRefsToChan(s, callback, include, exclude, s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
 }
@@ -102,13 +247,21 @@ func (s *GitScanner) ScanRefs(include, exclude []string, cb GitScannerFoundPoint
 // ref but not reachable from the "exclude" ref, including objects that have
 // been modified or deleted.
 func (s *GitScanner) ScanRefRange(include, exclude string, cb GitScannerFoundPointer) error {
+	return s.ScanRefRangeContext(s.ctx, include, exclude, cb)
+}
+
+// ScanRefRangeContext is like ScanRefRange, but scopes the scan to ctx
+// instead of the one passed to NewGitScanner, so a single call can be
+// cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanRefRangeContext(ctx context.Context, include, exclude string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanRefsMode)
+	opts := s.opts(ctx, ScanRefsMode)
 	opts.SkipDeletedBlobs = false
+	defer opts.tracker().done()
 	return scanRefsToChanSingleIncludeExclude(s, callback, include, exclude, s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
 }
 
@@ -117,12 +270,19 @@ func (s *GitScanner) ScanRefRange(include, exclude string, cb GitScannerFoundPoi
 // been modified or deleted.  Objects which appear in multiple trees will
 // be visited once per tree.
 func (s *GitScanner) ScanRefRangeByTree(include, exclude string, cb GitScannerFoundPointer) error {
+	return s.ScanRefRangeByTreeContext(s.ctx, include, exclude, cb)
+}
+
+// ScanRefRangeByTreeContext is like ScanRefRangeByTree, but scopes the scan
+// to ctx instead of the one passed to NewGitScanner, so a single call can be
+// cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanRefRangeByTreeContext(ctx context.Context, include, exclude string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanRefsMode)
+	opts := s.opts(ctx, ScanRefsMode)
 	opts.SkipDeletedBlobs = false
 	opts.CommitsOnly = true
 	return scanRefsByTree(s, callback, []string{include}, []string{exclude}, s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
@@ -137,13 +297,21 @@ func (s *GitScanner) ScanRefWithDeleted(ref string, cb GitScannerFoundPointer) e
 // ScanRef scans through all unique objects in the current ref, excluding
 // objects that have been modified or deleted before the ref.
 func (s *GitScanner) ScanRef(ref string, cb GitScannerFoundPointer) error {
+	return s.ScanRefContext(s.ctx, ref, cb)
+}
+
+// ScanRefContext is like ScanRef, but scopes the scan to ctx instead of the
+// one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanRefContext(ctx context.Context, ref string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanRefsMode)
+	opts := s.opts(ctx, ScanRefsMode)
 	opts.SkipDeletedBlobs = true
+	defer opts.tracker().done()
 	return scanRefsToChanSingleIncludeExclude(s, callback, ref, "", s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
 }
 
@@ -151,12 +319,19 @@ func (s *GitScanner) ScanRef(ref string, cb GitScannerFoundPointer) error {
 // objects that have been modified or deleted before the ref.  Objects which
 // appear in multiple trees will be visited once per tree.
 func (s *GitScanner) ScanRefByTree(ref string, cb GitScannerFoundPointer) error {
+	return s.ScanRefByTreeContext(s.ctx, ref, cb)
+}
+
+// ScanRefByTreeContext is like ScanRefByTree, but scopes the scan to ctx
+// instead of the one passed to NewGitScanner, so a single call can be
+// cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanRefByTreeContext(ctx context.Context, ref string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanRefsMode)
+	opts := s.opts(ctx, ScanRefsMode)
 	opts.SkipDeletedBlobs = true
 	opts.CommitsOnly = true
 	return scanRefsByTree(s, callback, []string{ref}, []string{}, s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
@@ -165,13 +340,21 @@ func (s *GitScanner) ScanRefByTree(ref string, cb GitScannerFoundPointer) error
 // ScanAll scans through all unique objects in the repository, including
 // objects that have been modified or deleted.
 func (s *GitScanner) ScanAll(cb GitScannerFoundPointer) error {
+	return s.ScanAllContext(s.ctx, cb)
+}
+
+// ScanAllContext is like ScanAll, but scopes the scan to ctx instead of the
+// one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanAllContext(ctx context.Context, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	opts := s.opts(ScanAllMode)
+	opts := s.opts(ctx, ScanAllMode)
 	opts.SkipDeletedBlobs = false
+	defer opts.tracker().done()
 	return scanRefsToChanSingleIncludeExclude(s, callback, "", "", s.cfg.GitEnv(), s.cfg.OSEnv(), opts)
 }
 
@@ -179,31 +362,52 @@ func (s *GitScanner) ScanAll(cb GitScannerFoundPointer) error {
 // ref. Differs from ScanRefs in that multiple files in the tree with the same
 // content are all reported.
 func (s *GitScanner) ScanTree(ref string, cb GitScannerFoundPointer) error {
+	return s.ScanTreeContext(s.ctx, ref, cb)
+}
+
+// ScanTreeContext is like ScanTree, but scopes the scan to ctx instead of the
+// one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanTreeContext(ctx context.Context, ref string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
-	return runScanTree(callback, ref, s.Filter, s.cfg.GitEnv(), s.cfg.OSEnv())
+	return runScanTree(ctx, callback, ref, s.Filter, s.cfg.GitEnv(), s.cfg.OSEnv(), s.Progress, s.progressInterval())
 }
 
 // ScanUnpushed scans history for all LFS pointers which have been added but not
 // pushed to the named remote. remote can be left blank to mean 'any remote'.
 func (s *GitScanner) ScanUnpushed(remote string, cb GitScannerFoundPointer) error {
+	return s.ScanUnpushedContext(s.ctx, remote, cb)
+}
+
+// ScanUnpushedContext is like ScanUnpushed, but scopes the scan to ctx
+// instead of the one passed to NewGitScanner, so a single call can be
+// cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanUnpushedContext(ctx context.Context, remote string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
-	return scanUnpushed(callback, remote)
+	return scanUnpushed(ctx, callback, remote, s.Progress, s.progressInterval())
 }
 
 // ScanStashed scans for all LFS pointers referenced solely by a stash
 func (s *GitScanner) ScanStashed(cb GitScannerFoundPointer) error {
+	return s.ScanStashedContext(s.ctx, cb)
+}
+
+// ScanStashedContext is like ScanStashed, but scopes the scan to ctx instead
+// of the one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanStashedContext(ctx context.Context, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
 
-	return scanStashed(callback)
+	return scanStashed(ctx, callback, s.Progress, s.progressInterval())
 }
 
 // ScanPreviousVersions scans changes reachable from ref (commit) back to since.
@@ -211,30 +415,77 @@ func (s *GitScanner) ScanStashed(cb GitScannerFoundPointer) error {
 // Does not include pointers which were still in use at ref (use ScanRefsToChan
 // for that)
 func (s *GitScanner) ScanPreviousVersions(ref string, since time.Time, cb GitScannerFoundPointer) error {
+	return s.ScanPreviousVersionsContext(s.ctx, ref, since, cb)
+}
+
+// ScanPreviousVersionsContext is like ScanPreviousVersions, but scopes the
+// scan to ctx instead of the one passed to NewGitScanner, so a single call
+// can be cancelled independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanPreviousVersionsContext(ctx context.Context, ref string, since time.Time, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
-	return logPreviousSHAs(callback, ref, s.Filter, since)
+	return logPreviousSHAs(ctx, callback, ref, s.Filter, since)
 }
 
 // ScanIndex scans the git index for modified LFS objects.
 func (s *GitScanner) ScanIndex(ref string, cb GitScannerFoundPointer) error {
+	return s.ScanIndexContext(s.ctx, ref, cb)
+}
+
+// ScanIndexContext is like ScanIndex, but scopes the scan to ctx instead of
+// the one passed to NewGitScanner, so a single call can be cancelled
+// independently of the rest of the GitScanner's lifetime.
+func (s *GitScanner) ScanIndexContext(ctx context.Context, ref string, cb GitScannerFoundPointer) error {
 	callback, err := firstGitScannerCallback(cb, s.FoundPointer)
 	if err != nil {
 		return err
 	}
-	return scanIndex(callback, ref, s.Filter, s.cfg.GitEnv(), s.cfg.OSEnv())
+	return scanIndex(ctx, callback, ref, s.Filter, s.cfg.GitEnv(), s.cfg.OSEnv(), s.Progress, s.progressInterval())
 }
 
-func (s *GitScanner) opts(mode ScanningMode) *ScanRefsOptions {
+func (s *GitScanner) opts(ctx context.Context, mode ScanningMode) *ScanRefsOptions {
 	opts := newScanRefsOptions()
 	opts.ScanMode = mode
 	opts.RemoteName = s.remote
 	opts.skippedRefs = s.skippedRefs
+	opts.Context = ctx
+	opts.Progress = s.Progress
+	opts.ProgressInterval = s.progressInterval()
+	opts.Concurrency = s.concurrency()
 	return opts
 }
 
+// progressInterval returns the throttle interval to use between
+// GitScannerProgress updates, falling back to
+// DefaultGitScannerProgressInterval when ProgressInterval is unset.
+func (s *GitScanner) progressInterval() time.Duration {
+	if s.ProgressInterval > 0 {
+		return s.ProgressInterval
+	}
+	return DefaultGitScannerProgressInterval
+}
+
+// concurrency returns the number of include refs that may be walked in
+// parallel, falling back to the lfs.concurrentscans git config value and
+// then runtime.GOMAXPROCS(0) when Concurrency is unset.
+func (s *GitScanner) concurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+
+	if n := s.cfg.Git.Int(lfsConcurrentScansConfigKey, 0); n > 0 {
+		return n
+	}
+
+	if n := runtime.GOMAXPROCS(0); n > 0 {
+		return n
+	}
+
+	return 1
+}
+
 func firstGitScannerCallback(callbacks ...GitScannerFoundPointer) (GitScannerFoundPointer, error) {
 	for _, cb := range callbacks {
 		if cb == nil {
@@ -254,14 +505,53 @@ const (
 	ScanRangeToRemoteMode = ScanningMode(iota)
 )
 
+// ScanRefsOptions configures a single scan. When Concurrency is greater than
+// one, the include refs are partitioned into up to that many shards (never
+// more shards than include refs) and walked in
+// parallel, each feeding the same FoundPointer callback under a mutex;
+// callers must not rely on the order in which FoundPointer is invoked, or on
+// commits/trees/blobs being visited in any particular sequence, once
+// concurrency is enabled. scanRefsToChan additionally deduplicates SHAs
+// against a seen-set guarded by mutex, so a sha reachable from more than one
+// include ref is still only reported to FoundPointer once overall; scans
+// that intentionally revisit the same sha at multiple paths, like ScanTree,
+// never populate that set.
 type ScanRefsOptions struct {
 	ScanMode         ScanningMode
 	RemoteName       string
 	SkipDeletedBlobs bool
 	CommitsOnly      bool
-	skippedRefs      []string
-	nameMap          map[string]string
-	mutex            *sync.Mutex
+	// Context bounds the git subprocesses spawned for this scan; cancelling
+	// it (or letting its deadline elapse) kills them and unblocks the
+	// channel pumps that feed FoundPointer.
+	Context context.Context
+	// Progress, if set, is called with a GitScannerProgressUpdate roughly
+	// every ProgressInterval while the scan runs.
+	Progress         GitScannerProgress
+	ProgressInterval time.Duration
+	// Concurrency is the number of include refs that may be walked in
+	// parallel by scanRefsToChan. Zero or one means no sharding.
+	Concurrency     int
+	skippedRefs     []string
+	nameMap         map[string]string
+	seen            map[string]struct{}
+	mutex           *sync.Mutex
+	progressOnce    sync.Once
+	progressTracker *scanProgressTracker
+}
+
+// tracker returns the scanProgressTracker for this scan, creating it on
+// first use. It is safe to call concurrently, so every shard of a
+// concurrent scan reports into the same tracker.
+func (o *ScanRefsOptions) tracker() *scanProgressTracker {
+	o.progressOnce.Do(func() {
+		interval := o.ProgressInterval
+		if interval <= 0 {
+			interval = DefaultGitScannerProgressInterval
+		}
+		o.progressTracker = newScanProgressTracker(o.Progress, interval)
+	})
+	return o.progressTracker
 }
 
 func (o *ScanRefsOptions) GetName(sha string) (string, bool) {
@@ -277,9 +567,712 @@ func (o *ScanRefsOptions) SetName(sha, name string) {
 	o.mutex.Unlock()
 }
 
+// dedupeSeen turns on seen-sha tracking for this scan; see markSeen.
+func (o *ScanRefsOptions) dedupeSeen() {
+	o.mutex.Lock()
+	if o.seen == nil {
+		o.seen = make(map[string]struct{})
+	}
+	o.mutex.Unlock()
+}
+
+// markSeen records sha as reported and reports whether it had already been
+// seen by a previous, possibly concurrent, call. Scans that never call
+// dedupeSeen leave o.seen nil, so markSeen is then always a no-op that
+// reports "not seen" and every call to FoundPointer goes through.
+func (o *ScanRefsOptions) markSeen(sha string) (alreadySeen bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.seen == nil {
+		return false
+	}
+
+	_, alreadySeen = o.seen[sha]
+	if !alreadySeen {
+		o.seen[sha] = struct{}{}
+	}
+	return alreadySeen
+}
+
 func newScanRefsOptions() *ScanRefsOptions {
 	return &ScanRefsOptions{
-		nameMap: make(map[string]string, 0),
-		mutex:   &sync.Mutex{},
+		Context:          context.Background(),
+		ProgressInterval: DefaultGitScannerProgressInterval,
+		nameMap:          make(map[string]string, 0),
+		mutex:            &sync.Mutex{},
+	}
+}
+
+// revListObject is a single line of "git rev-list --objects" or equivalent
+// output: a sha, and, for trees and blobs, the path it was found at.
+type revListObject struct {
+	Sha  string
+	Name string
+}
+
+// startGitCommand starts "git <args...>" as a subprocess bound to ctx:
+// cancelling ctx, or letting its deadline elapse, kills the subprocess
+// instead of leaving it to drain on its own. Callers must read the returned
+// stdout to EOF and call Cmd.Wait to release the process's resources.
+func startGitCommand(ctx context.Context, gitEnv, osEnv []string, args ...string) (*exec.Cmd, io.ReadCloser, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	tracerx.Printf("run_git: %v", args)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = gitScanEnv(gitEnv, osEnv)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	return cmd, stdout, nil
+}
+
+// startGitCommandStdin is like startGitCommand, but also returns a pipe for
+// the subprocess's stdin, for pipelines like "git cat-file --batch" that take
+// their input incrementally rather than as arguments.
+func startGitCommandStdin(ctx context.Context, gitEnv, osEnv []string, args ...string) (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	tracerx.Printf("run_git: %v", args)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = gitScanEnv(gitEnv, osEnv)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return cmd, stdin, stdout, nil
+}
+
+func gitScanEnv(gitEnv, osEnv []string) []string {
+	env := make([]string, 0, len(osEnv)+len(gitEnv))
+	env = append(env, osEnv...)
+	env = append(env, gitEnv...)
+	return env
+}
+
+// revListArgs builds the "git rev-list --objects" arguments that walk every
+// commit, tree and blob reachable from include but not from exclude.
+func revListArgs(include, exclude []string) []string {
+	args := []string{"rev-list", "--objects"}
+	if len(include) == 0 {
+		args = append(args, "--all")
+	} else {
+		args = append(args, include...)
+	}
+
+	for _, ref := range exclude {
+		if len(ref) == 0 {
+			continue
+		}
+		args = append(args, "^"+ref)
+	}
+
+	return args
+}
+
+// pumpRevListObjects reads null-free "git rev-list --objects" output from
+// stdout and feeds it to out, one line at a time, until stdout is exhausted
+// or ctx is cancelled. It always closes stdout and out before returning.
+func pumpRevListObjects(ctx context.Context, stdout io.ReadCloser, out chan<- revListObject) {
+	defer close(out)
+	defer stdout.Close()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+
+		sha, name, _ := strings.Cut(line, " ")
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- revListObject{Sha: sha, Name: name}:
+		}
+	}
+}
+
+// splitNUL is a bufio.SplitFunc for NUL-delimited output, e.g. from
+// "git ls-tree -z".
+func splitNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[0:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// pumpLsTreeObjects reads NUL-delimited "git ls-tree -r -z" entries from
+// stdout and feeds the blobs among them, filtered through filter, to out.
+func pumpLsTreeObjects(ctx context.Context, stdout io.ReadCloser, filter *filepathfilter.Filter, out chan<- revListObject) {
+	defer close(out)
+	defer stdout.Close()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(splitNUL)
+
+	for scanner.Scan() {
+		meta, path, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+
+		if filter != nil && !filter.Allows(path) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- revListObject{Sha: fields[2], Name: path}:
+		}
+	}
+}
+
+// pumpDiffIndexObjects reads "git diff-index" raw-format entries from stdout
+// and feeds the post-image blob of each, filtered through filter, to out.
+func pumpDiffIndexObjects(ctx context.Context, stdout io.ReadCloser, filter *filepathfilter.Filter, out chan<- revListObject) {
+	defer close(out)
+	defer stdout.Close()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || line[0] != ':' {
+			continue
+		}
+
+		meta, path, ok := strings.Cut(line[1:], "\t")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(meta)
+		if len(fields) < 4 {
+			continue
+		}
+
+		if filter != nil && !filter.Allows(path) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- revListObject{Sha: fields[3], Name: path}:
+		}
+	}
+}
+
+// catFileBatch feeds the shas in objects to "git cat-file --batch", decodes
+// each blob it gets back as an LFS pointer, and reports the ones that decode
+// successfully to pointerCb. It stops as soon as ctx is cancelled.
+func catFileBatch(ctx context.Context, pointerCb GitScannerFoundPointer, objects <-chan revListObject, gitEnv, osEnv []string, opt *ScanRefsOptions) error {
+	cmd, stdin, stdout, err := startGitCommandStdin(ctx, gitEnv, osEnv, "cat-file", "--batch")
+	if err != nil {
+		return err
+	}
+
+	shas := make(chan revListObject, 100)
+
+	go func() {
+		defer close(shas)
+		defer stdin.Close()
+
+		for obj := range objects {
+			if len(obj.Name) > 0 {
+				if _, ok := opt.GetName(obj.Sha); !ok {
+					opt.SetName(obj.Sha, obj.Name)
+				}
+			}
+
+			if _, err := io.WriteString(stdin, obj.Sha+"\n"); err != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case shas <- obj:
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(stdout)
+
+	var readErr error
+	for obj := range shas {
+		sha := obj.Sha
+		if err := ctx.Err(); err != nil {
+			readErr = err
+			break
+		}
+
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			readErr = err
+			break
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) < 2 || fields[1] == "missing" {
+			continue
+		}
+
+		kind := fields[1]
+		var size int64
+		if len(fields) >= 3 {
+			size, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+
+		content := io.LimitReader(reader, size)
+		tracker := opt.tracker()
+
+		switch kind {
+		case "commit":
+			tracker.addCommits(1)
+		case "tree":
+			tracker.addTrees(1)
+		case "blob":
+			tracker.addBlobs(1)
+			tracker.addBytes(uint64(size))
+			if p, decodeErr := DecodePointer(content); decodeErr == nil && p != nil && !opt.markSeen(sha) {
+				name := obj.Name
+				if len(name) == 0 {
+					name, _ = opt.GetName(sha)
+				}
+				tracker.addPointers(1)
+				pointerCb(&WrappedPointer{Sha1: sha, Name: name, Size: p.Size, Pointer: p}, nil)
+			}
+		}
+		io.Copy(io.Discard, content)
+
+		if _, err := reader.Discard(1); err != nil && err != io.EOF {
+			readErr = err
+			break
+		}
+	}
+
+	stdout.Close()
+
+	if waitErr := cmd.Wait(); readErr == nil {
+		readErr = waitErr
+	}
+
+	return readErr
+}
+
+// scanRefsToChanSingleIncludeMultiExclude walks every object reachable from
+// the single include ref but not from any of exclude, via a
+// "git rev-list --objects | git cat-file --batch" pipeline bound to
+// opt.Context: cancelling that context kills both subprocesses and unblocks
+// this goroutine instead of waiting for the pipeline to drain. With
+// opt.SkipDeletedBlobs only the include ref's own tree is walked, not the
+// history behind it; in ScanRangeToRemoteMode objects reachable from the
+// remote-tracking refs of opt.RemoteName are left out as well.
+func scanRefsToChanSingleIncludeMultiExclude(scanner *GitScanner, pointerCb GitScannerFoundPointer, include string, exclude []string, gitEnv, osEnv []string, opt *ScanRefsOptions) error {
+	if opt == nil {
+		panic("no scan options")
+	}
+
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var includes []string
+	if len(include) > 0 {
+		includes = []string{include}
+	}
+
+	args := revListArgs(includes, exclude)
+	if opt.SkipDeletedBlobs {
+		args = append(args, "--no-walk")
+	}
+	if opt.ScanMode == ScanRangeToRemoteMode && len(opt.RemoteName) > 0 {
+		args = append(args, "--not", "--remotes="+opt.RemoteName)
+	}
+
+	cmd, stdout, err := startGitCommand(ctx, gitEnv, osEnv, args...)
+	if err != nil {
+		return err
+	}
+
+	objects := make(chan revListObject, 100)
+	go pumpRevListObjects(ctx, stdout, objects)
+
+	err = catFileBatch(ctx, pointerCb, objects, gitEnv, osEnv, opt)
+	waitErr := cmd.Wait()
+
+	if err != nil {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return waitErr
+}
+
+// scanRefsToChanSingleIncludeExclude is scanRefsToChanSingleIncludeMultiExclude
+// for the common case of a single exclude ref.
+func scanRefsToChanSingleIncludeExclude(scanner *GitScanner, pointerCb GitScannerFoundPointer, include, exclude string, gitEnv, osEnv []string, opt *ScanRefsOptions) error {
+	var excludes []string
+	if len(exclude) > 0 {
+		excludes = []string{exclude}
+	}
+	return scanRefsToChanSingleIncludeMultiExclude(scanner, pointerCb, include, excludes, gitEnv, osEnv, opt)
+}
+
+// scanRefsToChan walks every object reachable from any of the include refs
+// but not from any of the exclude refs, stopping as soon as opt.Context is
+// cancelled. A sha reachable from more than one include ref is still only
+// reported to pointerCb once overall, via opt.markSeen. When opt.Concurrency
+// is greater than one, include is partitioned into that many shards, each
+// walked by its own rev-list/cat-file pipeline concurrently; see the
+// ScanRefsOptions doc comment for the ordering guarantees that drops.
+func scanRefsToChan(scanner *GitScanner, pointerCb GitScannerFoundPointer, include, exclude []string, gitEnv, osEnv []string, opt *ScanRefsOptions) error {
+	if opt == nil {
+		panic("no scan options")
+	}
+	defer opt.tracker().done()
+	opt.dedupeSeen()
+
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if len(include) == 0 {
+		return scanRefsToChanSingleIncludeMultiExclude(scanner, pointerCb, "", exclude, gitEnv, osEnv, opt)
+	}
+
+	shards := shardRefs(include, opt.Concurrency)
+	if len(shards) <= 1 {
+		for _, ref := range include {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := scanRefsToChanSingleIncludeMultiExclude(scanner, pointerCb, ref, exclude, gitEnv, osEnv, opt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var mu sync.Mutex
+	syncedCb := func(p *WrappedPointer, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		pointerCb(p, err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for _, shard := range shards {
+		shard := shard
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, ref := range shard {
+				if err := ctx.Err(); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+				if err := scanRefsToChanSingleIncludeMultiExclude(scanner, syncedCb, ref, exclude, gitEnv, osEnv, opt); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// shardRefs partitions include round-robin into at most n shards (ref i goes
+// to shard i%n), so scanRefsToChan can walk each shard's refs with its own
+// rev-list/cat-file pipeline concurrently. A single shard (n <= 1, or
+// len(include) <= 1) falls back to the serial path.
+func shardRefs(include []string, n int) [][]string {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(include) {
+		n = len(include)
+	}
+	if n <= 1 {
+		return [][]string{include}
+	}
+
+	shards := make([][]string, n)
+	for i, ref := range include {
+		shards[i%n] = append(shards[i%n], ref)
+	}
+	return shards
+}
+
+// scanRefsByTree is like scanRefsToChan, but walks the include refs one after
+// another and keeps no seen-set across them, so a sha reachable from several
+// include refs is reported once per ref. Within one include ref, rev-list
+// lists each sha once, so an object that appears at several paths or in
+// several trees is reported only once, under the first path rev-list gives.
+func scanRefsByTree(scanner *GitScanner, pointerCb GitScannerFoundPointer, include, exclude []string, gitEnv, osEnv []string, opt *ScanRefsOptions) error {
+	if opt == nil {
+		panic("no scan options")
+	}
+	defer opt.tracker().done()
+
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for _, ref := range include {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := scanRefsToChanSingleIncludeMultiExclude(scanner, pointerCb, ref, exclude, gitEnv, osEnv, opt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runScanTree reports every LFS pointer in the tree at ref, via
+// "git ls-tree -r -z | git cat-file --batch" bound to ctx.
+func runScanTree(ctx context.Context, pointerCb GitScannerFoundPointer, ref string, filter *filepathfilter.Filter, gitEnv, osEnv []string, progress GitScannerProgress, progressInterval time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	opt := newScanRefsOptions()
+	opt.Context = ctx
+	opt.Progress = progress
+	opt.ProgressInterval = progressInterval
+	defer opt.tracker().done()
+
+	cmd, stdout, err := startGitCommand(ctx, gitEnv, osEnv, "ls-tree", "-r", "-z", ref)
+	if err != nil {
+		return err
+	}
+
+	objects := make(chan revListObject, 100)
+	go pumpLsTreeObjects(ctx, stdout, filter, objects)
+
+	err = catFileBatch(ctx, pointerCb, objects, gitEnv, osEnv, opt)
+	waitErr := cmd.Wait()
+
+	if err != nil {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return waitErr
+}
+
+// scanUnpushed reports every LFS pointer introduced by a commit on a local
+// branch that the given remote (or, if blank, no remote) does not yet have.
+func scanUnpushed(ctx context.Context, pointerCb GitScannerFoundPointer, remote string, progress GitScannerProgress, progressInterval time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	opt := newScanRefsOptions()
+	opt.Context = ctx
+	opt.Progress = progress
+	opt.ProgressInterval = progressInterval
+	defer opt.tracker().done()
+
+	args := []string{"rev-list", "--branches", "--objects", "--not"}
+	if len(remote) > 0 {
+		args = append(args, "--remotes="+remote)
+	} else {
+		args = append(args, "--remotes")
+	}
+
+	cmd, stdout, err := startGitCommand(ctx, nil, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	objects := make(chan revListObject, 100)
+	go pumpRevListObjects(ctx, stdout, objects)
+
+	err = catFileBatch(ctx, pointerCb, objects, nil, nil, opt)
+	waitErr := cmd.Wait()
+
+	if err != nil {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return waitErr
+}
+
+// scanStashed reports every LFS pointer reachable only from refs/stash.
+func scanStashed(ctx context.Context, pointerCb GitScannerFoundPointer, progress GitScannerProgress, progressInterval time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	opt := newScanRefsOptions()
+	opt.Context = ctx
+	opt.Progress = progress
+	opt.ProgressInterval = progressInterval
+	defer opt.tracker().done()
+
+	cmd, stdout, err := startGitCommand(ctx, nil, nil, "rev-list", "-g", "--objects", "--no-walk", "refs/stash")
+	if err != nil {
+		return err
+	}
+
+	objects := make(chan revListObject, 100)
+	go pumpRevListObjects(ctx, stdout, objects)
+
+	err = catFileBatch(ctx, pointerCb, objects, nil, nil, opt)
+	waitErr := cmd.Wait()
+
+	if err != nil {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return waitErr
+}
+
+// logPreviousSHAs reports pointers that were replaced by a later commit
+// reachable from ref, on or after since, by scanning "git log -p" output for
+// the removed side of each pointer file diff.
+func logPreviousSHAs(ctx context.Context, pointerCb GitScannerFoundPointer, ref string, filter *filepathfilter.Filter, since time.Time) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	args := []string{"log", "--diff-filter=M", "--since=" + since.Format(time.RFC3339), "-p", ref}
+
+	cmd, stdout, err := startGitCommand(ctx, nil, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var readErr error
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			readErr = err
+			break
+		}
+
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "-oid ") && !strings.HasPrefix(line, "-oid:") {
+			continue
+		}
+
+		if p, decodeErr := DecodePointer(strings.NewReader(line[1:] + "\n")); decodeErr == nil && p != nil {
+			pointerCb(&WrappedPointer{Sha1: p.Oid, Size: p.Size, Pointer: p}, nil)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		readErr = err
+	}
+
+	stdout.Close()
+
+	if waitErr := cmd.Wait(); readErr == nil {
+		readErr = waitErr
+	}
+	if readErr == nil {
+		readErr = ctx.Err()
+	}
+
+	return readErr
+}
+
+// scanIndex reports every LFS pointer staged in the index that differs from
+// the one committed at ref, via "git diff-index | git cat-file --batch"
+// bound to ctx.
+func scanIndex(ctx context.Context, pointerCb GitScannerFoundPointer, ref string, filter *filepathfilter.Filter, gitEnv, osEnv []string, progress GitScannerProgress, progressInterval time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	opt := newScanRefsOptions()
+	opt.Context = ctx
+	opt.Progress = progress
+	opt.ProgressInterval = progressInterval
+	defer opt.tracker().done()
+
+	cmd, stdout, err := startGitCommand(ctx, gitEnv, osEnv, "diff-index", "--cached", "-M", "--no-renames", ref)
+	if err != nil {
+		return err
+	}
+
+	objects := make(chan revListObject, 100)
+	go pumpDiffIndexObjects(ctx, stdout, filter, objects)
+
+	err = catFileBatch(ctx, pointerCb, objects, gitEnv, osEnv, opt)
+	waitErr := cmd.Wait()
+
+	if err != nil {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
 	}
+	return waitErr
 }
@@ -0,0 +1,96 @@
+package lfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardRefs(t *testing.T) {
+	refs := []string{"a", "b", "c", "d", "e"}
+
+	assert.Equal(t, [][]string{refs}, shardRefs(refs, 0))
+	assert.Equal(t, [][]string{refs}, shardRefs(refs, 1))
+	assert.Equal(t, [][]string{nil}, shardRefs(nil, 4))
+
+	shards := shardRefs(refs, 2)
+	assert.Equal(t, [][]string{{"a", "c", "e"}, {"b", "d"}}, shards)
+
+	// every ref is assigned to exactly one shard
+	shards = shardRefs(refs, 8)
+	assert.Len(t, shards, len(refs))
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		for _, ref := range shard {
+			seen[ref] = true
+		}
+	}
+	assert.Len(t, seen, len(refs))
+}
+
+// runGit runs a git command in dir, failing the test on error.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@test.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@test.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// TestScanRefsToChanDedupesAcrossShards builds a repo with two branches that
+// both reach the same LFS pointer blob, and asserts that a concurrent,
+// sharded scanRefsToChan still reports that blob's sha to FoundPointer
+// exactly once.
+func TestScanRefsToChanDedupesAcrossShards(t *testing.T) {
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q")
+
+	pointer := "version https://git-lfs.github.com/spec/v1\n" +
+		"oid sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n" +
+		"size 0\n"
+	if err := os.WriteFile(filepath.Join(repo, "a.bin"), []byte(pointer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "add", "a.bin")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	runGit(t, repo, "branch", "other")
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(repo); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	var mu sync.Mutex
+	var found []string
+	cb := func(p *WrappedPointer, err error) {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		mu.Lock()
+		found = append(found, p.Sha1)
+		mu.Unlock()
+	}
+
+	opt := newScanRefsOptions()
+	opt.Concurrency = 2
+
+	err = scanRefsToChan(nil, cb, []string{"master", "other"}, nil, nil, nil, opt)
+	assert.Nil(t, err)
+	assert.Len(t, found, 1)
+}